@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/griffinplus/envrun/internal/db"
+)
+
+// runImport implements 'envrun import <file>': it merges the variables
+// defined in a standard .env file into the database, so users can seed
+// EnvRun from a file instead of a chain of @@envrun[set ...] tags.
+func runImport(args []string) error {
+
+	if len(args) != 1 {
+		return fmt.Errorf("usage: EnvRun.exe import <file>")
+	}
+
+	maxLines := resolveMaxLines()
+	imported, err := db.Read(args[0], maxLines)
+	if err != nil {
+		return err
+	}
+
+	dbPath := resolveDatabasePath()
+	variables, err := db.Read(dbPath, maxLines)
+	if err != nil {
+		return err
+	}
+
+	for name, value := range imported {
+		variables[name] = value
+	}
+
+	return db.Write(dbPath, variables)
+}
+
+// runExport implements 'envrun export <file>': it writes the database out
+// as a standard .env file that other tools can source or parse.
+func runExport(args []string) error {
+
+	if len(args) != 1 {
+		return fmt.Errorf("usage: EnvRun.exe export <file>")
+	}
+
+	variables, err := db.Read(resolveDatabasePath(), resolveMaxLines())
+	if err != nil {
+		return err
+	}
+
+	return db.WriteDotenv(args[0], variables)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/griffinplus/envrun/internal/db"
+)
+
+// TestImportExportRoundTrip exercises 'envrun import' followed by 'envrun
+// export', the way a user migrating a project onto EnvRun or handing a
+// database to another tool would.
+func TestImportExportRoundTrip(t *testing.T) {
+
+	dir := t.TempDir()
+	t.Setenv("ENVRUN_DATABASE", dir+"/envrun.db")
+
+	source := dir + "/source.env"
+	if err := os.WriteFile(source, []byte("FOO=plain\nBAR=\"it's quoted\"\n"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	if err := runImport([]string{source}); err != nil {
+		t.Fatalf("runImport: %v", err)
+	}
+
+	exported := dir + "/exported.env"
+	if err := runExport([]string{exported}); err != nil {
+		t.Fatalf("runExport: %v", err)
+	}
+
+	variables, err := db.Read(exported, db.DefaultMaxLines)
+	if err != nil {
+		t.Fatalf("db.Read: %v", err)
+	}
+
+	want := map[string]string{"FOO": "plain", "BAR": "it's quoted"}
+	for name, value := range want {
+		if variables[name] != value {
+			t.Errorf("%s: got %q, want %q", name, variables[name], value)
+		}
+	}
+}
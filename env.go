@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/griffinplus/envrun/internal/db"
+)
+
+// runEnv implements the 'envrun env' subcommand, modeled on 'go env' and
+// 'shrt env': it lets scripts inspect and mutate the envrun database
+// directly, without wrapping a process.
+func runEnv(args []string) error {
+
+	var export, nullSep, write, unset bool
+	var rest []string
+
+	for _, arg := range args {
+		switch arg {
+		case "-export":
+			export = true
+		case "-0":
+			nullSep = true
+		case "-w":
+			write = true
+		case "-u":
+			unset = true
+		case "-h", "-help", "--help":
+			printEnvUsage()
+			return nil
+		default:
+			rest = append(rest, arg)
+		}
+	}
+
+	if write && unset {
+		return fmt.Errorf("-w and -u cannot be combined")
+	}
+
+	dbPath := resolveDatabasePath()
+	variables, err := db.Read(dbPath, resolveMaxLines())
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case write:
+		return envWrite(dbPath, variables, rest)
+	case unset:
+		return envUnset(dbPath, variables, rest)
+	case len(rest) > 0:
+		return envPrintNamed(variables, rest, nullSep)
+	default:
+		return envPrintAll(variables, export, nullSep)
+	}
+}
+
+// envWrite sets defaults persistently, accepting one or more NAME=VALUE
+// assignments.
+func envWrite(dbPath string, variables map[string]string, assignments []string) error {
+
+	if len(assignments) == 0 {
+		return fmt.Errorf("-w requires at least one NAME=VALUE assignment")
+	}
+
+	for _, assignment := range assignments {
+		name, value, ok := strings.Cut(assignment, "=")
+		if !ok {
+			return fmt.Errorf("invalid assignment %q, expected NAME=VALUE", assignment)
+		}
+		variables[name] = value
+	}
+
+	return db.Write(dbPath, variables)
+}
+
+// envUnset removes one or more variables from the database.
+func envUnset(dbPath string, variables map[string]string, names []string) error {
+
+	if len(names) == 0 {
+		return fmt.Errorf("-u requires at least one variable name")
+	}
+
+	for _, name := range names {
+		delete(variables, name)
+	}
+
+	return db.Write(dbPath, variables)
+}
+
+// envPrintNamed prints the values of the requested variables, one per line
+// (or NUL-separated with -0), in the order they were requested. A name that
+// is not set prints as an empty line, matching 'go env'.
+func envPrintNamed(variables map[string]string, names []string, nullSep bool) error {
+
+	sep := "\n"
+	if nullSep {
+		sep = "\x00"
+	}
+
+	for _, name := range names {
+		fmt.Printf("%s%s", variables[name], sep)
+	}
+
+	return nil
+}
+
+// envPrintAll prints every stored variable in ascending name order, either
+// as NAME=VALUE pairs or, with -export, as a POSIX 'export' shell script
+// that can be sourced directly.
+func envPrintAll(variables map[string]string, export bool, nullSep bool) error {
+
+	sep := "\n"
+	if nullSep {
+		sep = "\x00"
+	}
+
+	for _, name := range db.Names(variables) {
+		if export {
+			fmt.Printf("export %s=%s%s", name, shellQuote(variables[name]), sep)
+		} else {
+			fmt.Printf("%s=%s%s", name, variables[name], sep)
+		}
+	}
+
+	return nil
+}
+
+// shellQuote wraps value in single quotes for POSIX shell consumption,
+// escaping any embedded single quote so the -export output always stays a
+// single, sourceable token regardless of what the value contains.
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+func printEnvUsage() {
+	fmt.Println("  USAGE:")
+	fmt.Println()
+	fmt.Println("    EnvRun.exe env                 Print all stored variables as NAME=VALUE pairs")
+	fmt.Println("    EnvRun.exe env -export          Print all stored variables as a POSIX 'export' script")
+	fmt.Println("    EnvRun.exe env -0               Separate printed entries with NUL instead of newline")
+	fmt.Println("    EnvRun.exe env NAME [NAME...]   Print the value of each named variable, one per line")
+	fmt.Println("    EnvRun.exe env -w NAME=VALUE... Set one or more variables persistently")
+	fmt.Println("    EnvRun.exe env -u NAME...       Remove one or more variables")
+}
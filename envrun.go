@@ -9,24 +9,22 @@ import (
 	"os/exec"
 	"path"
 	"regexp"
-	"sort"
+	"strconv"
+	"strings"
 	"syscall"
+
+	"github.com/griffinplus/envrun/internal/db"
 )
 
-var databaseLineRegex = regexp.MustCompile(`^\s*(.+?)\s*=\s*'(.*?)'\s*$`)
 var expandedVariableRegex = regexp.MustCompile(`{{\s*(.+?)\s*}}`)
 var envRunCommandRegex = regexp.MustCompile(`@@envrun\[\s*(.+?)\s*]`)
 var setVariableCommandRegex = regexp.MustCompile(`^set\s*name\s*=\s*'(.+?)'\s*value\s*=\s*'(.*?)'$`)
 var resetVariableCommandRegex = regexp.MustCompile(`^reset\s*name\s*=\s*'(.*?)'$`)
 
-func main() {
-
-	// print usage information, if no parameters are specified
-	args := os.Args[1:]
-	if len(args) == 0 {
-		printUsage()
-		os.Exit(1)
-	}
+// runWrap implements the original EnvRun behavior: it runs the specified
+// application, scans its stdout/stderr for @@envrun[...] tags and persists
+// the resulting variables to the database.
+func runWrap(args []string) {
 
 	// replace environment variables wrapped in double curly braces, e.g. {{name}}, in arguments
 	for i, arg := range args {
@@ -39,107 +37,146 @@ func main() {
 	}
 
 	// determine the path of the envrun database file
-	dbPath := os.Getenv("ENVRUN_DATABASE")
-	if len(dbPath) == 0 {
-		dir, err := os.Getwd()
-		if err != nil {
-			log.Fatalf("ERROR: %v\n", err)
-		}
-		dbPath = path.Join(dir, "envrun.db")
-		dbPath = path.Clean(dbPath)
-		os.Setenv("ENVRUN_DATABASE", dbPath)
-		fmt.Printf("The ENVRUN_DATABASE environment variable is not set, using %s instead.\n", dbPath)
-	}
+	dbPath := resolveDatabasePath()
 
 	// read envrun database
-	variables := readEnvrunDatabaseFile(dbPath)
+	variables, err := db.Read(dbPath, resolveMaxLines())
+	if err != nil {
+		log.Fatalf("ERROR: %v\n", err)
+	}
 
 	// run specified application and process stdout and stderr to
-	// detect envrun variable setter patterns
+	// detect envrun variable setter patterns; the JSON sideband, if the
+	// child opts in via ENVRUN_FD, feeds into the same store
+	store := newVariableStore(variables)
 	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = buildChildEnv(variables)
+	cmd.Stdin = os.Stdin
 	stdout, _ := cmd.StdoutPipe()
 	stderr, _ := cmd.StderrPipe()
-	go processOutputStream(stdout, os.Stdout, variables)
-	go processOutputStream(stderr, os.Stderr, variables)
+
+	band, err := enableSideband(cmd)
+	if err != nil {
+		log.Fatalf("ERROR: %v\n", err)
+	}
+
+	go processOutputStream(stdout, os.Stdout, store)
+	go processOutputStream(stderr, os.Stderr, store)
+
 	if err := cmd.Start(); err != nil {
 		log.Fatalf("ERROR: %v\n", err)
-	} else if err := cmd.Wait(); err != nil {
+	}
+
+	if band != nil {
+		band.closeChildEnds()
+		go band.run(store)
+	}
+
+	// exitCode is non-zero when the wrapped application itself exited
+	// non-zero; it is applied only after the database has been written, so
+	// a failing run (e.g. a failing test that still recorded state) does
+	// not lose whatever the child set
+	exitCode := 0
+	if err := cmd.Wait(); err != nil {
 		if exiterr, ok := err.(*exec.ExitError); ok {
 			if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
-				exitcode := status.ExitStatus()
-				os.Exit(exitcode)
+				exitCode = status.ExitStatus()
 			}
 		} else {
 			log.Fatalf("ERROR: %v\n", err)
 		}
 	}
 
-	// write envrun database
-	writeEnvrunDatabaseFile(dbPath, variables)
-}
-
-func readEnvrunDatabaseFile(path string) map[string]string {
-
-	variables := make(map[string]string)
+	if band != nil {
+		band.wait()
+		band.close()
+	}
 
-	// open file for reading
-	file, err := os.Open(path)
-	if os.IsNotExist(err) {
-		return variables
-	} else if err != nil {
+	// write envrun database
+	if err := db.Write(dbPath, store.snapshot()); err != nil {
 		log.Fatalf("ERROR: %v\n", err)
 	}
-	defer file.Close()
 
-	// read file
-	scanner := bufio.NewScanner(file)
-	for lineNo := 1; scanner.Scan(); lineNo++ {
-		line := scanner.Text()
-		match := databaseLineRegex.FindStringSubmatch(line)
-		if len(match) == 0 {
-			log.Fatalf("ERROR: Reading envrun database file failed (line: %d).", lineNo)
-		}
-		name := match[1]
-		value := match[2]
-		variables[name] = value
+	if exitCode != 0 {
+		os.Exit(exitCode)
 	}
+}
 
-	if err := scanner.Err(); err != nil {
-		log.Fatalf("ERROR: %v\n", err)
+// resolveDatabasePath determines the path of the envrun database file from
+// the ENVRUN_DATABASE environment variable, falling back to envrun.db in the
+// current working directory. It also exports the resolved path via
+// ENVRUN_DATABASE so the wrapped process can locate the same file. If a
+// profile was selected via -profile or ENVRUN_PROFILE, it is applied as a
+// sibling file, e.g. envrun.db becomes envrun.ci.db for profile "ci".
+func resolveDatabasePath() string {
+
+	dbPath := os.Getenv("ENVRUN_DATABASE")
+	if len(dbPath) == 0 {
+		dir, err := os.Getwd()
+		if err != nil {
+			log.Fatalf("ERROR: %v\n", err)
+		}
+		dbPath = path.Join(dir, "envrun.db")
+		dbPath = path.Clean(dbPath)
+		os.Setenv("ENVRUN_DATABASE", dbPath)
+		fmt.Printf("The ENVRUN_DATABASE environment variable is not set, using %s instead.\n", dbPath)
 	}
 
-	return variables
+	return applyProfile(dbPath)
 }
 
-func writeEnvrunDatabaseFile(path string, variables map[string]string) {
+// applyProfile inserts the selected profile name, if any, ahead of dbPath's
+// extension.
+func applyProfile(dbPath string) string {
 
-	// open file for writing
-	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
-	if err != nil {
-		log.Fatalf("ERROR: %v\n", err)
+	profile := os.Getenv("ENVRUN_PROFILE")
+	if profile == "" {
+		return dbPath
 	}
-	defer file.Close()
 
-	// sort variable names in ascending order
-	var names []string
-	for name := range variables {
-		names = append(names, name)
+	ext := path.Ext(dbPath)
+	base := strings.TrimSuffix(dbPath, ext)
+	return fmt.Sprintf("%s.%s%s", base, profile, ext)
+}
+
+// resolveMaxLines determines the maximum number of lines EnvRun will read
+// from a database or imported file, from the ENVRUN_MAX_LINES environment
+// variable, falling back to db.DefaultMaxLines.
+func resolveMaxLines() int {
+
+	if s := os.Getenv("ENVRUN_MAX_LINES"); s != "" {
+		if n, err := strconv.Atoi(s); err == nil && n > 0 {
+			return n
+		}
+		log.Printf("WARNING: Ignoring invalid ENVRUN_MAX_LINES value %q.\n", s)
 	}
-	sort.Strings(names)
 
-	// write file
-	writer := bufio.NewWriter(file)
-	for _, name := range names {
-		line := fmt.Sprintf("%s = '%s'\n", name, variables[name])
-		writer.WriteString(line)
+	return db.DefaultMaxLines
+}
+
+// buildChildEnv assembles the environment passed to the wrapped process by
+// appending the stored variables to the current process environment. Since
+// exec.Cmd keeps only the last value for a duplicate key, entries from the
+// database take precedence over identically named variables the wrapper
+// itself inherited, letting a previous @@envrun[set ...] feed back into the
+// next run.
+func buildChildEnv(variables map[string]string) []string {
+
+	env := os.Environ()
+	for _, name := range db.Names(variables) {
+		env = append(env, fmt.Sprintf("%s=%s", name, variables[name]))
 	}
-	writer.Flush()
+
+	return env
 }
 
+// processOutputStream tees the child's output through to output while
+// scanning it for @@envrun[...] tags, feeding any it finds into store
+// through the same dispatchCommand path the JSON sideband uses.
 func processOutputStream(
 	input io.ReadCloser,
 	output *os.File,
-	variables map[string]string) {
+	store *variableStore) {
 
 	reader := io.TeeReader(input, output)
 	scanner := bufio.NewScanner(reader)
@@ -156,17 +193,14 @@ func processOutputStream(
 			// @@envrun[set name='...' value='...']
 			innerEnvrunTagMatch := setVariableCommandRegex.FindStringSubmatch(envrunTagMatch[1])
 			if innerEnvrunTagMatch != nil {
-				name := innerEnvrunTagMatch[1]
-				value := innerEnvrunTagMatch[2]
-				variables[name] = value
+				dispatchCommand(store, "set", innerEnvrunTagMatch[1], innerEnvrunTagMatch[2], nil, nil)
 				continue outer
 			}
 
 			// @@envrun[reset name='...']
 			innerEnvrunTagMatch = resetVariableCommandRegex.FindStringSubmatch(envrunTagMatch[1])
 			if innerEnvrunTagMatch != nil {
-				name := innerEnvrunTagMatch[1]
-				delete(variables, name)
+				dispatchCommand(store, "reset", innerEnvrunTagMatch[1], "", nil, nil)
 				continue outer
 			}
 		}
@@ -187,6 +221,9 @@ func printUsage() {
 	fmt.Println("    Set ENVRUN_DATABASE environment variable to the path of the database file.")
 	fmt.Println("    If not set, the database (envrun.db) is placed into the working directory.")
 	fmt.Println()
+	fmt.Println("    Pass -profile NAME (or set ENVRUN_PROFILE) to keep separate sets of")
+	fmt.Println("    variables, e.g. dev/ci/release, in sibling files such as envrun.ci.db.")
+	fmt.Println()
 	fmt.Println("  Step 2)")
 	fmt.Println("    Start applications: EnvRun.exe <path> <arguments>")
 	fmt.Println()
@@ -194,6 +231,17 @@ func printUsage() {
 	fmt.Println("  - @@envrun[set name='<name>' value='<value>']")
 	fmt.Println("  - @@envrun[reset name='<name>']")
 	fmt.Println()
+	fmt.Println("  Go-based children can avoid the stdout tag format entirely by setting")
+	fmt.Println("  ENVRUN_FD in their own environment and using the envrunclient package, which")
+	fmt.Println("  exchanges structured set/reset/get/list commands over a dedicated pipe.")
+	fmt.Println()
+	fmt.Println("  Step 3, optional)")
+	fmt.Println("    Inspect or edit the database directly: EnvRun.exe env ...")
+	fmt.Println("    Run 'EnvRun.exe env -h' for details.")
+	fmt.Println()
+	fmt.Println("  Step 4, optional)")
+	fmt.Println("    Round-trip the database through a standard .env file:")
+	fmt.Println("    EnvRun.exe import <file>, EnvRun.exe export <file>")
 	fmt.Println("------------------------------------------------------------------------------------------------------------------------")
 	fmt.Println("  Full Version:", fullVersion)
 	fmt.Println("  Project: https://github.com/griffinplus/envrun")
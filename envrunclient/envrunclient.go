@@ -0,0 +1,172 @@
+// Package envrunclient lets a Go child process exchange structured
+// set/reset/get/list commands with its wrapping EnvRun process over a
+// dedicated pipe, as an alternative to emitting @@envrun[...] tags on
+// stdout/stderr. Set, Reset, Get and List return an error unless the parent
+// enabled the sideband by setting ENVRUN_FD and ENVRUN_REPLY_FD in the
+// child's environment; Enabled reports whether it did.
+package envrunclient
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+type message struct {
+	Op    string `json:"op"`
+	Name  string `json:"name,omitempty"`
+	Value string `json:"value,omitempty"`
+	ID    uint64 `json:"id,omitempty"`
+}
+
+type reply struct {
+	ID     uint64            `json:"id"`
+	Value  string            `json:"value,omitempty"`
+	Found  bool              `json:"found,omitempty"`
+	Values map[string]string `json:"values,omitempty"`
+}
+
+var (
+	mu       sync.Mutex
+	request  *os.File
+	response *bufio.Reader
+	nextID   uint64
+)
+
+// Enabled reports whether the parent process set up the sideband for this
+// process, i.e. whether Set, Reset, Get and List can be used at all.
+func Enabled() bool {
+	_, _, ok := sidebandFDs()
+	return ok
+}
+
+func sidebandFDs() (int, int, bool) {
+
+	requestVar, ok := os.LookupEnv("ENVRUN_FD")
+	if !ok {
+		return 0, 0, false
+	}
+	replyVar, ok := os.LookupEnv("ENVRUN_REPLY_FD")
+	if !ok {
+		return 0, 0, false
+	}
+
+	requestFD, err := strconv.Atoi(requestVar)
+	if err != nil {
+		return 0, 0, false
+	}
+	replyFD, err := strconv.Atoi(replyVar)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	return requestFD, replyFD, true
+}
+
+// ensureOpen lazily opens the request/reply pipes on first use so importing
+// the package has no effect on a process that never calls into it.
+func ensureOpen() error {
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if request != nil {
+		return nil
+	}
+
+	requestFD, replyFD, ok := sidebandFDs()
+	if !ok {
+		return fmt.Errorf("envrunclient: ENVRUN_FD/ENVRUN_REPLY_FD not set, the parent process did not enable the sideband")
+	}
+
+	request = os.NewFile(uintptr(requestFD), "envrun-request")
+	response = bufio.NewReader(os.NewFile(uintptr(replyFD), "envrun-reply"))
+	return nil
+}
+
+// send writes a fire-and-forget command, used by Set and Reset.
+func send(msg message) error {
+
+	if err := ensureOpen(); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	_, err = request.Write(append(data, '\n'))
+	return err
+}
+
+// call writes a command and waits for its matching reply, used by Get and
+// List. Requests are serialized under mu so replies can never be read out
+// of order.
+func call(msg message) (reply, error) {
+
+	if err := ensureOpen(); err != nil {
+		return reply{}, err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	msg.ID = atomic.AddUint64(&nextID, 1)
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return reply{}, err
+	}
+	if _, err := request.Write(append(data, '\n')); err != nil {
+		return reply{}, err
+	}
+
+	line, err := response.ReadBytes('\n')
+	if err != nil {
+		return reply{}, err
+	}
+
+	var rep reply
+	if err := json.Unmarshal(line, &rep); err != nil {
+		return reply{}, err
+	}
+	return rep, nil
+}
+
+// Set stores name=value in the EnvRun database, equivalent to
+// @@envrun[set name='...' value='...'] but without any quoting concerns
+// and able to carry multi-line values.
+func Set(name, value string) error {
+	return send(message{Op: "set", Name: name, Value: value})
+}
+
+// Reset removes name from the EnvRun database, equivalent to
+// @@envrun[reset name='<name>'].
+func Reset(name string) error {
+	return send(message{Op: "reset", Name: name})
+}
+
+// Get retrieves the current value of name from the EnvRun database. found
+// is false if name is not set.
+func Get(name string) (value string, found bool, err error) {
+	rep, err := call(message{Op: "get", Name: name})
+	if err != nil {
+		return "", false, err
+	}
+	return rep.Value, rep.Found, nil
+}
+
+// List retrieves every variable currently stored in the EnvRun database.
+func List() (map[string]string, error) {
+	rep, err := call(message{Op: "list"})
+	if err != nil {
+		return nil, err
+	}
+	return rep.Values, nil
+}
@@ -0,0 +1,392 @@
+// Package db reads and writes the EnvRun database file that persists
+// variables between runs. It is shared by the process wrapper and the
+// `envrun env`/`envrun import`/`envrun export` subcommands so they all
+// agree on the exact same file format.
+package db
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// DefaultMaxLines bounds how many lines Parse will read from a single
+// source before giving up, following the example set by OpenSSH and
+// Teleport config parsers: a well-formed database never gets anywhere
+// near this size, so hitting it means something (often a child process
+// dumping unexpected output into a file EnvRun was pointed at) produced
+// pathological input.
+const DefaultMaxLines = 1000
+
+// assignmentNameRegex matches every name Write will persist, so a round
+// trip through Write then Parse/Read never fails on a name the writer
+// itself accepted; it is deliberately wider than a shell identifier to
+// admit the dotted/hyphenated names the @@envrun[set name='...'] tag
+// grammar has always allowed.
+var assignmentNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*$`)
+var expandVariableRegex = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}|\$([A-Za-z_][A-Za-z0-9_]*)`)
+
+// Read loads the variables stored in the database file at path, accepting
+// up to maxLines lines of input. A missing file is not an error; it yields
+// an empty set so a project can start using EnvRun without creating the
+// database file up front. A shared lock on path's sidecar lock file is held
+// for the duration of the read so a concurrent Write cannot be observed
+// half-written.
+func Read(path string, maxLines int) (map[string]string, error) {
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return make(map[string]string), nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	lockFile, err := openLockFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer lockFile.Close()
+
+	if err := lockShared(lockFile); err != nil {
+		return nil, err
+	}
+	defer unlock(lockFile)
+
+	return Parse(file, maxLines)
+}
+
+// openLockFile opens (creating if necessary) the sidecar file used to
+// coordinate readers and writers of path. It is a fixed name distinct from
+// path itself and, unlike path, is never replaced by Write's rename, so
+// every Read/Write call locks the same inode instead of racing a writer
+// that has already moved its replacement into place.
+func openLockFile(path string) (*os.File, error) {
+	return os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0644)
+}
+
+// Parse reads a dotenv-style stream from r, in the style of gotenv: blank
+// lines and lines starting with '#' are ignored, an optional leading
+// "export " is stripped, and values may be unquoted, single-quoted
+// (literal) or double-quoted (escape-processed). $NAME and ${NAME}
+// references inside unquoted and double-quoted values are expanded against
+// entries defined earlier in the stream, falling back to the process
+// environment. Reading stops with an error once more than maxLines lines
+// have been consumed.
+func Parse(r io.Reader, maxLines int) (map[string]string, error) {
+
+	variables := make(map[string]string)
+
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		if lineNo > maxLines {
+			return nil, fmt.Errorf("input exceeds the maximum of %d lines", maxLines)
+		}
+
+		line := scanner.Text()
+		if lineNo == 1 {
+			line = strings.TrimPrefix(line, "\ufeff")
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if rest, ok := strings.CutPrefix(line, "export"); ok && (rest == "" || rest[0] == ' ' || rest[0] == '\t') {
+			line = strings.TrimSpace(rest)
+		}
+
+		name, rawValue, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed assignment (line: %d)", lineNo)
+		}
+
+		name = strings.TrimSpace(name)
+		if !assignmentNameRegex.MatchString(name) {
+			return nil, fmt.Errorf("invalid variable name %q (line: %d)", name, lineNo)
+		}
+
+		value, err := parseValue(strings.TrimSpace(rawValue), variables)
+		if err != nil {
+			return nil, fmt.Errorf("%v (line: %d)", err, lineNo)
+		}
+
+		variables[name] = value
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return variables, nil
+}
+
+// parseValue interprets the right-hand side of a single assignment,
+// applying quoting rules and, where applicable, variable expansion.
+func parseValue(rawValue string, variables map[string]string) (string, error) {
+
+	if rawValue == "" {
+		return "", nil
+	}
+
+	switch rawValue[0] {
+	case '\'':
+		if len(rawValue) < 2 || rawValue[len(rawValue)-1] != '\'' {
+			return "", fmt.Errorf("unterminated single-quoted value")
+		}
+		return rawValue[1 : len(rawValue)-1], nil
+
+	case '"':
+		if len(rawValue) < 2 || rawValue[len(rawValue)-1] != '"' {
+			return "", fmt.Errorf("unterminated double-quoted value")
+		}
+		return expandDoubleQuoted(rawValue[1:len(rawValue)-1], variables), nil
+
+	default:
+		return expandVariables(rawValue, variables), nil
+	}
+}
+
+// expandDoubleQuoted processes the backslash escapes recognized inside a
+// double-quoted value and expands $NAME/${NAME} references in the same
+// pass. Doing both in one pass matters: a backslash-escaped dollar (the
+// form encodeDoubleQuoted produces for a literal '$') must come out as a
+// plain '$', not be handed to expansion a second time once unescaped.
+func expandDoubleQuoted(s string, variables map[string]string) string {
+
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+			switch s[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case '"', '\\', '$':
+				b.WriteByte(s[i])
+			default:
+				b.WriteByte('\\')
+				b.WriteByte(s[i])
+			}
+			i++
+			continue
+		}
+
+		if s[i] == '$' {
+			if loc := expandVariableRegex.FindStringIndex(s[i:]); loc != nil && loc[0] == 0 {
+				sub := expandVariableRegex.FindStringSubmatch(s[i : i+loc[1]])
+				name := sub[1]
+				if name == "" {
+					name = sub[2]
+				}
+				if value, ok := variables[name]; ok {
+					b.WriteString(value)
+				} else {
+					b.WriteString(os.Getenv(name))
+				}
+				i += loc[1]
+				continue
+			}
+		}
+
+		b.WriteByte(s[i])
+		i++
+	}
+
+	return b.String()
+}
+
+// encodeValue renders value for the canonical DB format: a plain value goes
+// out single-quoted, as before, but a value that a single-quoted literal
+// cannot represent - because it contains a newline, carriage return or a
+// single quote itself, as a multi-line value set through the sideband
+// commonly will - goes out double-quoted and escaped instead, so Parse can
+// read it back as a single physical line.
+func encodeValue(value string) string {
+	if strings.ContainsAny(value, "\n\r'") {
+		return encodeDoubleQuoted(value)
+	}
+	return "'" + value + "'"
+}
+
+// encodeDoubleQuoted escapes value the way expandDoubleQuoted expects to
+// unescape it.
+func encodeDoubleQuoted(value string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range value {
+		switch r {
+		case '"', '\\', '$':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// expandVariables replaces $NAME and ${NAME} references with the value of
+// name in variables, falling back to the process environment.
+func expandVariables(s string, variables map[string]string) string {
+
+	return expandVariableRegex.ReplaceAllStringFunc(s, func(match string) string {
+		sub := expandVariableRegex.FindStringSubmatch(match)
+		name := sub[1]
+		if name == "" {
+			name = sub[2]
+		}
+		if value, ok := variables[name]; ok {
+			return value
+		}
+		return os.Getenv(name)
+	})
+}
+
+// Write persists variables to the database file at path in EnvRun's own
+// canonical format, replacing any previous content. Names are written in
+// ascending order so repeated writes of the same data produce a stable
+// diff. A name that assignmentNameRegex would reject aborts the write
+// entirely with an error, rather than being written and then failing to
+// load on the next Read.
+//
+// Write takes an exclusive lock on path's sidecar lock file for the
+// duration of the call, so concurrent EnvRun invocations sharing a
+// database (e.g. parallel CI jobs) serialize instead of corrupting each
+// other's writes. The lock file is never itself replaced, so it keeps
+// coordinating readers and writers across any number of renames of path.
+// The new content is written to a uniquely named temporary file in the
+// same directory and moved into place with os.Rename, so a reader can
+// never observe a partially written file, and two writers racing for the
+// lock can never collide on a shared temporary name.
+func Write(path string, variables map[string]string) error {
+
+	lockFile, err := openLockFile(path)
+	if err != nil {
+		return err
+	}
+	defer lockFile.Close()
+
+	if err := lockExclusive(lockFile); err != nil {
+		return err
+	}
+	defer unlock(lockFile)
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmpFile.Name()
+	defer os.Remove(tmpPath)
+
+	writer := bufio.NewWriter(tmpFile)
+	for _, name := range Names(variables) {
+		if !assignmentNameRegex.MatchString(name) {
+			tmpFile.Close()
+			return fmt.Errorf("invalid variable name %q", name)
+		}
+		if _, err := fmt.Fprintf(writer, "%s = %s\n", name, encodeValue(variables[name])); err != nil {
+			tmpFile.Close()
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// WriteDotenv writes variables to path as a standard .env file, quoting
+// values only where necessary so the result stays readable and round-trips
+// through common dotenv tooling, not just EnvRun itself.
+func WriteDotenv(path string, variables map[string]string) error {
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	for _, name := range Names(variables) {
+		if _, err := fmt.Fprintf(writer, "%s=%s\n", name, quoteDotenvValue(variables[name])); err != nil {
+			return err
+		}
+	}
+
+	return writer.Flush()
+}
+
+// quoteDotenvValue quotes value for WriteDotenv, leaving values made up of
+// ordinary identifier-like characters unquoted and falling back to
+// double-quoted, escaped output when the value itself contains a single
+// quote, a newline or a carriage return.
+func quoteDotenvValue(value string) string {
+
+	if value == "" {
+		return "''"
+	}
+
+	plain := true
+	for _, r := range value {
+		if !(unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-' || r == '.' || r == '/' || r == ':') {
+			plain = false
+			break
+		}
+	}
+	if plain {
+		return value
+	}
+
+	if !strings.ContainsAny(value, "'\n\r") {
+		return "'" + value + "'"
+	}
+
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range value {
+		switch r {
+		case '"', '\\', '$':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// Names returns the variable names of variables in ascending order.
+func Names(variables map[string]string) []string {
+	names := make([]string, 0, len(variables))
+	for name := range variables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,138 @@
+package db
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseEncodeRoundTrip(t *testing.T) {
+
+	variables := map[string]string{
+		"PLAIN":       "value",
+		"EMPTY":       "",
+		"SINGLEQUOTE": "it's here",
+		"MULTILINE":   "line1\nline2",
+		"LITERALVAR":  "PATH=\\$HOME/bin",
+	}
+
+	var encoded strings.Builder
+	for _, name := range Names(variables) {
+		encoded.WriteString(name + " = " + encodeValue(variables[name]) + "\n")
+	}
+
+	parsed, err := Parse(strings.NewReader(encoded.String()), DefaultMaxLines)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+
+	for name, want := range variables {
+		if got := parsed[name]; got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+}
+
+// TestParseEscapedDollarNotExpanded guards against an escaped '$' inside a
+// double-quoted value being unescaped and then handed to variable expansion
+// a second time, which would silently turn a literal "$HOME" into the
+// current process's HOME.
+func TestParseEscapedDollarNotExpanded(t *testing.T) {
+
+	t.Setenv("HOME", "/home/tester")
+
+	parsed, err := Parse(strings.NewReader(`VAR = "literal \$HOME here"`+"\n"), DefaultMaxLines)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+
+	want := "literal $HOME here"
+	if got := parsed["VAR"]; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestParseExpandsUnescapedReference(t *testing.T) {
+
+	t.Setenv("HOME", "/home/tester")
+
+	parsed, err := Parse(strings.NewReader(`VAR = "path is $HOME"`+"\n"), DefaultMaxLines)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+
+	want := "path is /home/tester"
+	if got := parsed["VAR"]; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestParseRejectsInvalidName(t *testing.T) {
+
+	if _, err := Parse(strings.NewReader("123BAD = 'x'\n"), DefaultMaxLines); err == nil {
+		t.Fatal("expected an error for an invalid variable name")
+	}
+}
+
+// TestParseAcceptsDottedAndHyphenatedNames guards the symmetry between Write
+// (which accepts these names) and Parse (which must be able to read them
+// back); the @@envrun[set name='...'] tag grammar has always allowed them.
+func TestParseAcceptsDottedAndHyphenatedNames(t *testing.T) {
+
+	parsed, err := Parse(strings.NewReader("my.setting-name = 'x'\n"), DefaultMaxLines)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if got := parsed["my.setting-name"]; got != "x" {
+		t.Errorf("got %q, want %q", got, "x")
+	}
+}
+
+func TestWriteRejectsUnroundtrippableName(t *testing.T) {
+
+	dir := t.TempDir()
+	if err := Write(dir+"/envrun.db", map[string]string{"bad name": "x"}); err == nil {
+		t.Fatal("expected an error for a name Parse could never read back")
+	}
+}
+
+// TestWriteReadRoundTrip exercises Write's locked, atomic rename and Read's
+// locked open together, the way runWrap does across two invocations.
+func TestWriteReadRoundTrip(t *testing.T) {
+
+	path := t.TempDir() + "/envrun.db"
+	variables := map[string]string{
+		"FOO": "plain",
+		"BAR": "it's multi\nline",
+	}
+
+	if err := Write(path, variables); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	got, err := Read(path, DefaultMaxLines)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	for name, want := range variables {
+		if got[name] != want {
+			t.Errorf("%s: got %q, want %q", name, got[name], want)
+		}
+	}
+
+	if _, err := os.Stat(path + ".lock"); err != nil {
+		t.Errorf("expected a lock sidecar file: %v", err)
+	}
+}
+
+func TestReadMissingFileReturnsEmptySet(t *testing.T) {
+
+	variables, err := Read(t.TempDir()+"/does-not-exist.db", DefaultMaxLines)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if len(variables) != 0 {
+		t.Errorf("got %v, want an empty set", variables)
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !windows
+
+package db
+
+import (
+	"os"
+	"syscall"
+)
+
+func lockShared(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_SH)
+}
+
+func lockExclusive(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_EX)
+}
+
+func unlock(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,71 @@
+//go:build windows
+
+package db
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	modkernel32      = syscall.NewLazyDLL("kernel32.dll")
+	procLockFileEx   = modkernel32.NewProc("LockFileEx")
+	procUnlockFileEx = modkernel32.NewProc("UnlockFileEx")
+)
+
+const lockfileExclusiveLock = 0x00000002
+
+// overlapped mirrors the Win32 OVERLAPPED struct. LockFileEx/UnlockFileEx
+// require one even for a synchronous lock; every lock taken here covers
+// the same single byte at offset 0 of the lock file.
+type overlapped struct {
+	Internal     uintptr
+	InternalHigh uintptr
+	Offset       uint32
+	OffsetHigh   uint32
+	HEvent       syscall.Handle
+}
+
+func lockFileEx(handle syscall.Handle, flags uint32) error {
+	var ol overlapped
+	r, _, err := procLockFileEx.Call(
+		uintptr(handle),
+		uintptr(flags),
+		0,
+		uintptr(1),
+		uintptr(0),
+		uintptr(unsafe.Pointer(&ol)),
+	)
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+func unlockFileEx(handle syscall.Handle) error {
+	var ol overlapped
+	r, _, err := procUnlockFileEx.Call(
+		uintptr(handle),
+		0,
+		uintptr(1),
+		uintptr(0),
+		uintptr(unsafe.Pointer(&ol)),
+	)
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+func lockShared(file *os.File) error {
+	return lockFileEx(syscall.Handle(file.Fd()), 0)
+}
+
+func lockExclusive(file *os.File) error {
+	return lockFileEx(syscall.Handle(file.Fd()), lockfileExclusiveLock)
+}
+
+func unlock(file *os.File) error {
+	return unlockFileEx(syscall.Handle(file.Fd()))
+}
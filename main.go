@@ -0,0 +1,59 @@
+package main
+
+import (
+	"log"
+	"os"
+)
+
+func main() {
+
+	// the -profile flag is recognized ahead of everything else, since it
+	// applies equally to the wrap-and-exec path and every subcommand
+	profile, args := extractProfileFlag(os.Args[1:])
+	if profile != "" {
+		os.Setenv("ENVRUN_PROFILE", profile)
+	}
+
+	// print usage information, if no parameters are specified
+	if len(args) == 0 {
+		printUsage()
+		os.Exit(1)
+	}
+
+	// dispatch to one of the database subcommands before falling back to
+	// the wrap-and-exec path that gives EnvRun its name
+	switch args[0] {
+	case "env":
+		if err := runEnv(args[1:]); err != nil {
+			log.Fatalf("ERROR: %v\n", err)
+		}
+		return
+	case "import":
+		if err := runImport(args[1:]); err != nil {
+			log.Fatalf("ERROR: %v\n", err)
+		}
+		return
+	case "export":
+		if err := runExport(args[1:]); err != nil {
+			log.Fatalf("ERROR: %v\n", err)
+		}
+		return
+	}
+
+	runWrap(args)
+}
+
+// extractProfileFlag pulls a leading "-profile NAME" out of args, returning
+// the profile name (empty if not given) and the remaining arguments in
+// order. It only recognizes "-profile" while it is still the leading
+// token: the moment a different argument is seen, that argument and
+// everything after it - which may be the wrapped application's own path
+// and arguments, e.g. a "-profile" of its own - is left untouched.
+func extractProfileFlag(args []string) (string, []string) {
+
+	if len(args) >= 2 && args[0] == "-profile" {
+		return args[1], args[2:]
+	}
+
+	return "", args
+}
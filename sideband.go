@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// sidebandEnableVar is the environment variable a child sets (to any value)
+// to opt into the structured sideband. EnvRun overwrites it with the real
+// request file descriptor once the sideband is wired up.
+const sidebandEnableVar = "ENVRUN_FD"
+
+// sidebandReplyVar carries the file descriptor the child reads replies
+// from; it is only meaningful once sidebandEnableVar has been overwritten.
+const sidebandReplyVar = "ENVRUN_REPLY_FD"
+
+// ExtraFiles are attached to a child starting at fd 3, in order, so with a
+// single request/reply pair the request pipe is always fd 3 and the reply
+// pipe is always fd 4.
+const sidebandRequestFD = 3
+const sidebandReplyFD = 4
+
+// sidebandMaxMessageSize bounds a single newline-delimited JSON message.
+// bufio.Scanner's own default (64 KiB) is too small for this protocol's
+// whole point: a child carrying a large multi-line value through a single
+// Set call. 16 MiB comfortably covers that while still catching a child
+// that never sends the newline the scanner is waiting for.
+const sidebandMaxMessageSize = 16 * 1024 * 1024
+
+type sidebandMessage struct {
+	Op    string `json:"op"`
+	Name  string `json:"name,omitempty"`
+	Value string `json:"value,omitempty"`
+	ID    uint64 `json:"id,omitempty"`
+}
+
+type sidebandReply struct {
+	ID     uint64            `json:"id"`
+	Value  string            `json:"value,omitempty"`
+	Found  bool              `json:"found,omitempty"`
+	Values map[string]string `json:"values,omitempty"`
+}
+
+// sideband is the parent side of the structured, newline-delimited
+// protocol children can use as an alternative to @@envrun[...] stdout tags.
+// It reads newline-delimited JSON commands from the child and, for commands
+// that expect an answer, writes a matching JSON reply.
+type sideband struct {
+	requestRead       *os.File
+	replyWrite        *os.File
+	childRequestWrite *os.File
+	childReplyRead    *os.File
+	done              chan struct{}
+}
+
+// enableSideband wires up the sideband on cmd if the child's environment
+// opts in by setting ENVRUN_FD. It returns nil, nil when the child did not
+// opt in.
+func enableSideband(cmd *exec.Cmd) (*sideband, error) {
+
+	if !envContainsKey(cmd.Env, sidebandEnableVar) {
+		return nil, nil
+	}
+
+	requestRead, requestWrite, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	replyRead, replyWrite, err := os.Pipe()
+	if err != nil {
+		requestRead.Close()
+		requestWrite.Close()
+		return nil, err
+	}
+
+	cmd.ExtraFiles = append(cmd.ExtraFiles, requestWrite, replyRead)
+	cmd.Env = append(cmd.Env, sidebandEnableVar+"="+strconv.Itoa(sidebandRequestFD))
+	cmd.Env = append(cmd.Env, sidebandReplyVar+"="+strconv.Itoa(sidebandReplyFD))
+
+	return &sideband{
+		requestRead:       requestRead,
+		replyWrite:        replyWrite,
+		childRequestWrite: requestWrite,
+		childReplyRead:    replyRead,
+		done:              make(chan struct{}),
+	}, nil
+}
+
+func envContainsKey(env []string, name string) bool {
+	prefix := name + "="
+	for _, kv := range env {
+		if strings.HasPrefix(kv, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// closeChildEnds closes the parent's copy of the file descriptors handed to
+// the child. Without this the parent would keep the write end of the
+// request pipe open too, and requestRead would never see EOF once the
+// child exits.
+func (s *sideband) closeChildEnds() {
+	s.childRequestWrite.Close()
+	s.childReplyRead.Close()
+}
+
+// run feeds commands read from the request pipe into store until the child
+// closes its end, then closes done.
+func (s *sideband) run(store *variableStore) {
+	defer close(s.done)
+
+	scanner := bufio.NewScanner(s.requestRead)
+	scanner.Buffer(make([]byte, 0, 64*1024), sidebandMaxMessageSize)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+
+		var msg sidebandMessage
+		if err := json.Unmarshal(line, &msg); err != nil {
+			continue
+		}
+
+		dispatchCommand(store, msg.Op, msg.Name, msg.Value, func() {
+			value, found := store.get(msg.Name)
+			s.reply(sidebandReply{ID: msg.ID, Value: value, Found: found})
+		}, func() {
+			s.reply(sidebandReply{ID: msg.ID, Values: store.snapshot()})
+		})
+	}
+
+	// a child that keeps the pipe open but never sends a complete message
+	// within sidebandMaxMessageSize, or any other scan failure, otherwise
+	// ends this loop exactly like a clean EOF would; surface it so it isn't
+	// mistaken for the child simply being done
+	if err := scanner.Err(); err != nil {
+		log.Printf("WARNING: sideband stopped reading commands: %v\n", err)
+	}
+}
+
+func (s *sideband) reply(rep sidebandReply) {
+	data, err := json.Marshal(rep)
+	if err != nil {
+		return
+	}
+	s.replyWrite.Write(append(data, '\n'))
+}
+
+// wait blocks until run has observed EOF on the request pipe.
+func (s *sideband) wait() {
+	<-s.done
+}
+
+func (s *sideband) close() {
+	s.requestRead.Close()
+	s.replyWrite.Close()
+}
@@ -0,0 +1,70 @@
+package main
+
+import "sync"
+
+// variableStore guards the in-memory set of variables EnvRun is tracking
+// for the current run. It is written to concurrently: the stdout scanner,
+// the stderr scanner and, when enabled, the JSON sideband all feed into the
+// same store from their own goroutines.
+type variableStore struct {
+	mu        sync.Mutex
+	variables map[string]string
+}
+
+func newVariableStore(variables map[string]string) *variableStore {
+	return &variableStore{variables: variables}
+}
+
+func (s *variableStore) set(name, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.variables[name] = value
+}
+
+func (s *variableStore) reset(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.variables, name)
+}
+
+func (s *variableStore) get(name string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.variables[name]
+	return value, ok
+}
+
+// snapshot returns a copy of the tracked variables, safe to hand to callers
+// that read the database after the wrapped process has exited.
+func (s *variableStore) snapshot() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	variables := make(map[string]string, len(s.variables))
+	for name, value := range s.variables {
+		variables[name] = value
+	}
+	return variables
+}
+
+// dispatchCommand applies a single set/reset/get/list command to store. It
+// is the single point both the @@envrun[...] text tag scanner and the JSON
+// sideband feed into, so the two input paths can never disagree on
+// semantics. onGet and onList are invoked instead of mutating the store,
+// since those commands only read it; either may be nil when the caller (the
+// text scanner) has no way to answer them.
+func dispatchCommand(store *variableStore, op, name, value string, onGet, onList func()) {
+	switch op {
+	case "set":
+		store.set(name, value)
+	case "reset":
+		store.reset(name)
+	case "get":
+		if onGet != nil {
+			onGet()
+		}
+	case "list":
+		if onList != nil {
+			onList()
+		}
+	}
+}